@@ -5,7 +5,8 @@ package main
 // and restructures for loading into a bigquery table called 'cyberprobe'.
 // One row per event.
 //
-// No output queues are used.
+// An output queue is only needed if DLQ_QUEUE names one of the process's
+// output arguments, for rows the sink can't store.
 //
 
 import (
@@ -13,7 +14,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	dt "github.com/trustnetworks/analytics-common/datatypes"
 	"github.com/trustnetworks/analytics-common/utils"
@@ -21,6 +24,7 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/storage/v1"
 )
 
 // Program name, for the log.
@@ -38,41 +42,17 @@ type work struct {
 	table   string            // Table name
 	svc     *bigquery.Service // Bigquery service handle.
 
-	count int
-	rows  bigquery.TableDataInsertAllRequest
+	schema    []Column   // Declarative table schema / event mapping.
+	enrichers []Enricher // Chain run after the schema mapping.
+
+	sink    Sink     // Storage backend rows are written to.
+	outputs []string // Output queue names the process was started with.
 }
 
-// The set of HTTP headers which are stored in the BigQuery table.
-// Don't forget to update schema below when changing.
-var wantedHttpHeaders map[string]bool = map[string]bool{
-	"Accept":                      true,
-	"Accept-Charset":              true,
-	"Accept-Language":             true,
-	"Access-Control-Allow-Origin": true,
-	"Authorization":               true,
-	"Connection":                  true,
-	"Content-Encoding":            true,
-	"Content-Language":            true,
-	"Content-Location":            true,
-	"Content-Type":                true,
-	"Cookie":                      true,
-	"Date":                        true,
-	"ETag":                        true,
-	"Forwarded":                   true,
-	"Host":                        true,
-	"Link":                        true,
-	"Location":                    true,
-	"Origin":                      true,
-	"Proxy-Authorization":         true,
-	"Referer":                     true,
-	"Server":                      true,
-	"Set-Cookie":                  true,
-	"Upgrade":                     true,
-	"User-Agent":                  true,
-	"Via":                         true,
-	"WWW-Authenticate":            true,
-	"X-Forwarded-For":             true,
-	"X-Forwarded-Host":            true,
+// httpHeaderFieldName turns an HTTP header name (e.g. "Content-Type")
+// into the BigQuery column name it's stored under ("contenttype").
+func httpHeaderFieldName(h string) string {
+	return strings.ToLower(strings.Replace(h, "-", "", -1))
 }
 
 // Initialisaition
@@ -98,8 +78,15 @@ func (s *work) init() error {
 		return err
 	}
 
-	// Access scope
-	config.Scopes = []string{bigquery.BigqueryScope}
+	// Access scope. LOAD_STAGE (the loadjob sink's GCS staging option)
+	// needs its own scope on the same client -- the sink has no
+	// opportunity to mint its own JWT, since it's only handed the
+	// *http.Client already built here.
+	scopes := []string{bigquery.BigqueryScope}
+	if utils.Getenv("LOAD_STAGE", "") != "" {
+		scopes = append(scopes, storage.DevstorageReadWriteScope)
+	}
+	config.Scopes = scopes
 
 	// Create service client.
 	s.client = config.Client(oauth2.NoContext)
@@ -113,289 +100,49 @@ func (s *work) init() error {
 
 	utils.Log("Connected.")
 
+	// Load the declarative table schema / event mapping. SCHEMA points
+	// at a JSON or YAML file; if unset, the schema the loader has
+	// always used is built in.
+	schemaPath := utils.Getenv("SCHEMA", "")
+	if schemaPath != "" {
+		s.schema, err = loadSchema(schemaPath)
+		if err != nil {
+			utils.Log("Couldn't load schema %s: %s", schemaPath, err.Error())
+			return err
+		}
+	} else {
+		s.schema = defaultSchema()
+	}
+
+	// Build the enrichment chain and fold the columns it contributes
+	// (header, GeoIP, indicator match) into the table schema.
+	s.enrichers = newEnrichers()
+	s.schema = append(s.schema, enricherColumns(s.enrichers)...)
+
 	// See if the table already exists.
-	_, err = s.svc.Tables.Get(s.project, s.dataset, s.table).Do()
+	tbl, err := s.svc.Tables.Get(s.project, s.dataset, s.table).Do()
 	if err != nil {
 
 		// Table does not exist, it will be created.
 		utils.Log("Table %s does not exist, creating...", s.table)
 
 		// Create table definition.
-		var tbl bigquery.Table
-		tbl.TableReference = &bigquery.TableReference{
+		var newTbl bigquery.Table
+		newTbl.TableReference = &bigquery.TableReference{
 			ProjectId: s.project,
 			DatasetId: s.dataset,
 			TableId:   s.table,
 		}
-		tbl.TimePartitioning = &bigquery.TimePartitioning{Type: "DAY"}
-		tbl.Kind = "bigquery#table"
-		tbl.Description = "cyberprobe event table"
-		tbl.Schema = &bigquery.TableSchema{}
-		tbl.Schema.Fields = []*bigquery.TableFieldSchema{
-			&bigquery.TableFieldSchema{
-				Name: "id",
-				Mode: "REQUIRED",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "time",
-				Mode: "REQUIRED",
-				Type: "TIMESTAMP",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "action",
-				Mode: "REQUIRED",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "device",
-				Mode: "REQUIRED",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "udp_src",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "udp_dest",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "tcp_src",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "tcp_dest",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "ipv4_src",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "ipv4_dest",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "type",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "query",
-				Mode: "REPEATED",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "answer",
-				Mode: "REPEATED",
-				Type: "RECORD",
-				Fields: []*bigquery.TableFieldSchema{
-					&bigquery.TableFieldSchema{
-						Name: "name",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "address",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-				},
-			},
-			&bigquery.TableFieldSchema{
-				Name: "method",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "status",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "code",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "size",
-				Mode: "NULLABLE",
-				Type: "INTEGER",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "header",
-				Mode: "NULLABLE",
-				Type: "RECORD",
-				Fields: []*bigquery.TableFieldSchema{
-					&bigquery.TableFieldSchema{
-						Name: "accept",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "acceptcharset",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "acceptlanguage",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "accesscontrolalloworigin",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "authorization",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "connection",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "contentencoding",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "contentlanguage",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "contentlocation",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "contenttype",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "cookie",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "date",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "etag",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "forwarded",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "host",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "link",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "location",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "origin",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "proxyauthorization",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "referer",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "server",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "setcookie",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "upgrade",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "useragent",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "via",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "wwwauthenticate",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "xforwardedfor",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-					&bigquery.TableFieldSchema{
-						Name: "xforwardedhost",
-						Mode: "NULLABLE",
-						Type: "STRING",
-					},
-				},
-			},
-			&bigquery.TableFieldSchema{
-				Name: "url",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "from",
-				Mode: "NULLABLE",
-				Type: "STRING",
-			},
-			&bigquery.TableFieldSchema{
-				Name: "to",
-				Mode: "REPEATED",
-				Type: "STRING",
-			},
+		newTbl.TimePartitioning = &bigquery.TimePartitioning{Type: "DAY"}
+		newTbl.Kind = "bigquery#table"
+		newTbl.Description = "cyberprobe event table"
+		newTbl.Schema = &bigquery.TableSchema{
+			Fields: toFieldSchema(s.schema),
 		}
 
 		// Create table.
 		_, err = s.svc.Tables.Insert(s.project, s.dataset,
-			&tbl).Do()
+			&newTbl).Do()
 		if err != nil {
 			utils.Log("Table create error: %s", err.Error())
 			return err
@@ -404,7 +151,36 @@ func (s *work) init() error {
 		utils.Log("Table %s created.", s.table)
 
 	} else {
+
 		utils.Log("Table %s exists.", s.table)
+
+		// BigQuery supports additive schema changes: patch in any
+		// top-level columns the schema file added that the live
+		// table doesn't have yet.
+		added := newColumns(tbl.Schema.Fields, s.schema)
+		if len(added) > 0 {
+
+			utils.Log("Adding %d new column(s) to %s.", len(added), s.table)
+
+			tbl.Schema.Fields = append(tbl.Schema.Fields, toFieldSchema(added)...)
+
+			_, err = s.svc.Tables.Patch(s.project, s.dataset, s.table, tbl).Do()
+			if err != nil {
+				utils.Log("Table patch error: %s", err.Error())
+				return err
+			}
+
+		}
+
+	}
+
+	// Pick the storage backend (SINK=stream|loadjob) and hand it the
+	// project/dataset/table/service handle it needs to write rows.
+	s.sink = newSink()
+	err = s.sink.Init(s)
+	if err != nil {
+		utils.Log("sink init: %s", err.Error())
+		return err
 	}
 
 	return nil
@@ -416,6 +192,8 @@ func (s *work) Handle(msg []uint8, w *worker.Worker) error {
 
 	//	utils.Log("%s", msg)
 
+	eventsProcessed.Inc()
+
 	// Decode JSON event
 	var e dt.Event
 	err := json.Unmarshal(msg, &e)
@@ -424,121 +202,43 @@ func (s *work) Handle(msg []uint8, w *worker.Worker) error {
 		return nil
 	}
 
+	// Decode again into a generic form so the schema's extract
+	// expressions can be evaluated against it.
+	var generic map[string]interface{}
+	err = json.Unmarshal(msg, &generic)
+	if err != nil {
+		utils.Log("Couldn't unmarshal json: %s", err.Error())
+		return nil
+	}
+
 	row := &bigquery.TableDataInsertAllRequestRows{
 		Json: map[string]bigquery.JsonValue{},
 	}
 
-	s.rows.Rows = append(s.rows.Rows, row)
-
-	// Populate data in insert request
+	// Populate data in insert request by walking the schema and
+	// evaluating each column's extract expression against the event.
 	values := &row.Json
-	if e.Id != "" {
-		(*values)["id"] = e.Id
-	}
-	if e.Action != "" {
-		(*values)["action"] = e.Action
-	}
-	if e.Device != "" {
-		(*values)["device"] = e.Device
-	}
-	if e.Time != "" {
-		(*values)["time"] = e.Time
-	}
+	for _, col := range s.schema {
 
-	// Convert HTTP header list into fields.
-	h := map[string]string{}
-
-	if e.HttpRequest != nil && len(e.HttpRequest.Header) > 0 {
-		for k, v := range e.HttpRequest.Header {
-			if _, ok := wantedHttpHeaders[k]; ok {
-				k = strings.Replace(k, "-", "", -1)
-				k = strings.ToLower(k)
-				h[k] = v
-			}
+		if col.Extract == "" {
+			continue
 		}
-	}
 
-	if e.HttpResponse != nil && len(e.HttpResponse.Header) > 0 {
-		for k, v := range e.HttpResponse.Header {
-			if _, ok := wantedHttpHeaders[k]; ok {
-				k = strings.Replace(k, "-", "", -1)
-				k = strings.ToLower(k)
-				h[k] = v
-			}
+		v, ok := extractColumn(generic, col)
+		if !ok {
+			continue
 		}
-	}
 
-	switch e.Action {
-	case "http_request":
-		if e.HttpRequest != nil {
-			(*values)["method"] = e.HttpRequest.Method
-		}
-		(*values)["header"] = &h
-	case "http_response":
-		if e.HttpResponse != nil {
-			(*values)["status"] = e.HttpResponse.Status
-			(*values)["code"] = e.HttpResponse.Code
-		}
-		(*values)["header"] = &h
-	case "ftp_command":
-		if e.FtpCommand != nil {
-			(*values)["command"] = e.FtpCommand.Command
-		}
-	case "ftp_response":
-		if e.FtpResponse != nil {
-			(*values)["status"] = e.FtpResponse.Status
-			(*values)["text"] = e.FtpResponse.Text
-		}
-	case "icmp":
-
-	case "dns_message":
-		if e.DnsMessage != nil {
-			if e.DnsMessage.Query != nil {
-				if len(e.DnsMessage.Query) > 0 {
-					(*values)["query"] = e.DnsMessage.Query
-				}
-			}
-			if e.DnsMessage.Answer != nil {
-				if len(e.DnsMessage.Answer) > 0 {
-					(*values)["answer"] = e.DnsMessage.Answer
-				}
+		// Some actions carry a single value (e.g. SIP's "to") where
+		// others carry a list; normalise to match the column's mode.
+		if col.Mode == "REPEATED" {
+			if single, ok := v.(string); ok {
+				v = []string{single}
 			}
-			(*values)["type"] = e.DnsMessage.Type
-		}
-	case "sip_request":
-		if e.SipRequest != nil {
-			(*values)["method"] = e.SipRequest.Method
-			(*values)["from"] = e.SipRequest.From
-			(*values)["to"] = []string{e.SipRequest.To}
-		}
-	case "sip_response":
-		if e.SipResponse != nil {
-			(*values)["code"] = e.SipResponse.Code
-			(*values)["status"] = e.SipResponse.Status
-			(*values)["from"] = e.SipResponse.From
-			(*values)["to"] = []string{e.SipResponse.To}
 		}
-	case "smtp_command":
-		if e.SmtpCommand != nil {
-			(*values)["command"] = e.SmtpCommand.Command
-		}
-	case "smtp_response":
-		if e.SmtpResponse != nil {
-			(*values)["status"] = e.SmtpResponse.Status
-			(*values)["text"] = e.SmtpResponse.Text
-		}
-	case "smtp_data":
-		if e.SmtpData != nil {
-			(*values)["from"] = e.SmtpData.From
-			(*values)["to"] = e.SmtpData.To
-		}
-	case "ntp_timestamp":
-	case "ntp_control":
-	case "ntp_private":
-	}
 
-	if e.Url != "" {
-		(*values)["url"] = e.Url
+		(*values)[col.Name] = v
+
 	}
 
 	// Convert source address list into table fields.
@@ -589,24 +289,12 @@ func (s *work) Handle(msg []uint8, w *worker.Worker) error {
 
 	}
 
-	s.count++
-
-	if s.count > insert_batch {
-
-		// FIXME: Don't need to do this at all?
-		s.rows.Kind = "biquery#tableDataInsertAllRequest"
-
-		// Table insert.
-		_, err = s.svc.Tabledata.InsertAll(s.project, s.dataset,
-			s.table, &s.rows).Do()
-		if err != nil {
-			utils.Log("InsertAll: %s", err.Error())
-			return nil
-		}
-
-		s.count = 0
-		s.rows.Rows = []*bigquery.TableDataInsertAllRequestRows{}
+	enrichAll(s.enrichers, &e, *values)
 
+	err = s.sink.Write(row, msg, w)
+	if err != nil {
+		utils.Log("sink write: %s", err.Error())
+		return nil
 	}
 
 	return nil
@@ -621,14 +309,9 @@ func main() {
 
 	utils.Log("Initialising...")
 
-	// Initialise BigQuery.
-	err := s.init()
-	if err != nil {
-		utils.Log("init: %s", err.Error())
-		return
-	}
-
-	// Initialise.
+	// Work out the queues we're started with before initialising
+	// BigQuery, so a sink's Init can validate DLQ_QUEUE against the
+	// output queues actually available to it.
 	var input string
 	var output []string
 
@@ -639,6 +322,15 @@ func main() {
 		output = os.Args[2:]
 	}
 
+	s.outputs = output
+
+	// Initialise BigQuery.
+	err := s.init()
+	if err != nil {
+		utils.Log("init: %s", err.Error())
+		return
+	}
+
 	err = w.Initialise(input, output, pgm)
 	if err != nil {
 		utils.Log("init: %s", err.Error())
@@ -647,7 +339,37 @@ func main() {
 
 	utils.Log("Initialisation complete.")
 
+	// Expose /metrics, /healthz and /readyz.
+	startMetricsServer(&s)
+
+	// On a Kubernetes rolling restart (SIGTERM) or Ctrl-C (SIGINT),
+	// flush whatever's buffered before the process exits rather than
+	// losing it. Close() only catches rows newly buffered since the
+	// sink's own periodic ticker last flushed; that ticker's flush can
+	// still be mid-retry (sleeping in backoff) when the signal arrives,
+	// so wait on flushWG too before exiting, or its rows would be
+	// abandoned underneath it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		utils.Log("Received %s, flushing and exiting.", sig)
+		err := s.sink.Close()
+		if err != nil {
+			utils.Log("sink close: %s", err.Error())
+		}
+		flushWG.Wait()
+		os.Exit(0)
+	}()
+
 	// Invoke Wye event handling.
 	w.Run(&s)
 
+	// Flush anything left buffered in the sink before exiting.
+	err = s.sink.Close()
+	if err != nil {
+		utils.Log("sink close: %s", err.Error())
+	}
+	flushWG.Wait()
+
 }
@@ -0,0 +1,100 @@
+package main
+
+//
+// Dead-letter forwarding shared by every sink that supports a DLQ_QUEUE
+// (currently StreamSink and LoadJobSink): rows that can't be stored --
+// poison rows BigQuery rejected, or a whole batch once retries are
+// exhausted -- are forwarded here with the original event and the
+// BigQuery error attached, rather than silently dropped.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// checkDlqQueue fails fast if DLQ_QUEUE is set to a queue the process
+// wasn't also given as an output argument: every dead-letter attempt
+// against a queue w.Output doesn't know about fails at row forward
+// time, silently dropping rows exactly as before DLQ_QUEUE existed.
+func checkDlqQueue(dlqQueue string, outputs []string) error {
+
+	if dlqQueue == "" {
+		return nil
+	}
+
+	for _, o := range outputs {
+		if o == dlqQueue {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("DLQ_QUEUE %s is not one of the configured output queues %v", dlqQueue, outputs)
+
+}
+
+// deadLetterAll forwards every row in a batch to the DLQ, used once
+// retries on a wholesale insert/load failure are exhausted.
+func deadLetterAll(dlqQueue string, w *worker.Worker, msgs [][]byte, reason string) {
+	for _, msg := range msgs {
+		deadLetter(dlqQueue, w, msg, reason)
+	}
+}
+
+// deadLetterInsertErrors forwards just the rows InsertAll rejected,
+// using the per-row errors it reported.
+func deadLetterInsertErrors(dlqQueue string, w *worker.Worker, msgs [][]byte, errs []*bigquery.TableDataInsertAllResponseInsertErrors) {
+
+	for _, e := range errs {
+
+		if int(e.Index) >= len(msgs) {
+			continue
+		}
+
+		reason := "insert error"
+		if len(e.Errors) > 0 {
+			reason = e.Errors[0].Reason + ": " + e.Errors[0].Message
+		}
+
+		deadLetter(dlqQueue, w, msgs[e.Index], reason)
+
+	}
+
+}
+
+// deadLetter forwards a single failed row, original event plus reason,
+// to dlqQueue via the worker's output routing.
+func deadLetter(dlqQueue string, w *worker.Worker, msg []byte, reason string) {
+
+	if dlqQueue == "" || w == nil {
+		utils.Log("Dropping row, no dead-letter queue configured: %s", reason)
+		return
+	}
+
+	dlq := struct {
+		Event json.RawMessage `json:"event"`
+		Error string          `json:"error"`
+	}{
+		Event: json.RawMessage(msg),
+		Error: reason,
+	}
+
+	enc, err := json.Marshal(&dlq)
+	if err != nil {
+		utils.Log("Dead-letter: couldn't encode: %s", err.Error())
+		return
+	}
+
+	err = w.Output(dlqQueue, enc)
+	if err != nil {
+		utils.Log("Dead-letter: couldn't forward to %s: %s", dlqQueue, err.Error())
+		return
+	}
+
+	deadLetterTotal.Inc()
+
+}
@@ -0,0 +1,85 @@
+package main
+
+//
+// Enrichment pipeline. Some columns can't be produced by a single
+// JSONPath lookup against the event -- GeoIP lookups, indicator
+// matching, the HTTP header allow-list -- so they're added by a chain
+// of Enrichers that run after the declarative schema mapping, rather
+// than forking the loader per customer.
+//
+
+import (
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/utils"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// Enricher adds columns to a row that a plain schema extract
+// expression can't produce.
+type Enricher interface {
+
+	// Columns returns the schema columns this enricher adds, so the
+	// table schema picks them up automatically.
+	Columns() []Column
+
+	// Enrich adds this enricher's columns to row, given the decoded
+	// event.
+	Enrich(e *dt.Event, row map[string]bigquery.JsonValue) error
+}
+
+// newEnrichers builds the enrichment chain. The header allow-list
+// enricher is always present (it replaces what used to be a hard-coded
+// map); GeoIP and indicator matching are each enabled by pointing their
+// env var at a database/list file.
+func newEnrichers() []Enricher {
+
+	chain := []Enricher{newHeaderEnricher()}
+
+	countryDB := utils.Getenv("GEOIP_COUNTRY_DB", "")
+	asnDB := utils.Getenv("GEOIP_ASN_DB", "")
+	if countryDB != "" || asnDB != "" {
+		e, err := newGeoIPEnricher(countryDB, asnDB)
+		if err != nil {
+			utils.Log("GeoIP enricher disabled: %s", err.Error())
+		} else {
+			chain = append(chain, e)
+		}
+	}
+
+	if path := utils.Getenv("IOC_FILE", ""); path != "" {
+		e, err := newIndicatorEnricher(path)
+		if err != nil {
+			utils.Log("Indicator enricher disabled: %s", err.Error())
+		} else {
+			chain = append(chain, e)
+		}
+	}
+
+	return chain
+
+}
+
+// enrichAll runs the full chain against a row. An individual
+// enricher's failure is logged and skipped rather than dropping the
+// row.
+func enrichAll(chain []Enricher, e *dt.Event, row map[string]bigquery.JsonValue) {
+	for _, en := range chain {
+		err := en.Enrich(e, row)
+		if err != nil {
+			utils.Log("Enrichment failed: %s", err.Error())
+		}
+	}
+}
+
+// enricherColumns collects the schema columns contributed by the
+// enrichment chain, for the table schema.
+func enricherColumns(chain []Enricher) []Column {
+
+	var cols []Column
+	for _, en := range chain {
+		cols = append(cols, en.Columns()...)
+	}
+
+	return cols
+
+}
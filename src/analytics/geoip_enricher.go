@@ -0,0 +1,115 @@
+package main
+
+//
+// GeoIPEnricher tags rows with the source/destination country and/or
+// ASN, looked up from MaxMind GeoLite2 databases. Country and ASN data
+// ship as separate database files/types (geoip2-golang rejects a
+// Country() lookup against an ASN database and vice versa), so they're
+// configured -- and loaded -- independently: GEOIP_COUNTRY_DB enables
+// the country columns, GEOIP_ASN_DB enables the ASN columns. Either,
+// both, or neither may be set.
+//
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// GeoIPEnricher adds src/dest country and/or ASN columns, depending on
+// which databases were configured.
+type GeoIPEnricher struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+}
+
+// newGeoIPEnricher opens whichever of countryPath/asnPath is non-empty.
+// It returns an error only if a configured path fails to open; at
+// least one of the two is guaranteed set by the caller.
+func newGeoIPEnricher(countryPath, asnPath string) (*GeoIPEnricher, error) {
+
+	g := &GeoIPEnricher{}
+
+	if countryPath != "" {
+		db, err := geoip2.Open(countryPath)
+		if err != nil {
+			return nil, err
+		}
+		g.country = db
+	}
+
+	if asnPath != "" {
+		db, err := geoip2.Open(asnPath)
+		if err != nil {
+			return nil, err
+		}
+		g.asn = db
+	}
+
+	return g, nil
+
+}
+
+func (g *GeoIPEnricher) Columns() []Column {
+
+	var cols []Column
+
+	if g.country != nil {
+		cols = append(cols,
+			Column{Name: "src_country", Mode: "NULLABLE", Type: "STRING"},
+			Column{Name: "dest_country", Mode: "NULLABLE", Type: "STRING"},
+		)
+	}
+
+	if g.asn != nil {
+		cols = append(cols,
+			Column{Name: "src_asn", Mode: "NULLABLE", Type: "INTEGER"},
+			Column{Name: "dest_asn", Mode: "NULLABLE", Type: "INTEGER"},
+		)
+	}
+
+	return cols
+
+}
+
+func (g *GeoIPEnricher) Enrich(e *dt.Event, row map[string]bigquery.JsonValue) error {
+	g.lookup(row, "ipv4_src", "src_country", "src_asn")
+	g.lookup(row, "ipv4_dest", "dest_country", "dest_asn")
+	return nil
+}
+
+// lookup resolves the address already written to addrField and, if
+// found, fills in the matching country/ASN columns from whichever
+// database(s) are configured.
+func (g *GeoIPEnricher) lookup(row map[string]bigquery.JsonValue, addrField, countryField, asnField string) {
+
+	v, ok := row[addrField]
+	if !ok {
+		return
+	}
+
+	addr, ok := v.(string)
+	if !ok || addr == "" {
+		return
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return
+	}
+
+	if g.country != nil {
+		if country, err := g.country.Country(ip); err == nil && country.Country.IsoCode != "" {
+			row[countryField] = country.Country.IsoCode
+		}
+	}
+
+	if g.asn != nil {
+		if asn, err := g.asn.ASN(ip); err == nil && asn.AutonomousSystemNumber != 0 {
+			row[asnField] = asn.AutonomousSystemNumber
+		}
+	}
+
+}
@@ -0,0 +1,97 @@
+package main
+
+//
+// HeaderEnricher builds the "header" RECORD column. It replaces what
+// used to be a hard-coded wantedHttpHeaders map: the allow-list is
+// still built in by default, but HEADER_ALLOWLIST lets it be changed
+// at runtime instead of requiring a rebuild.
+//
+
+import (
+	"strings"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"github.com/trustnetworks/analytics-common/utils"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// Default set of HTTP headers stored in the BigQuery table, used when
+// HEADER_ALLOWLIST isn't set.
+var defaultHttpHeaders = []string{
+	"Accept", "Accept-Charset", "Accept-Language",
+	"Access-Control-Allow-Origin", "Authorization", "Connection",
+	"Content-Encoding", "Content-Language", "Content-Location",
+	"Content-Type", "Cookie", "Date", "ETag", "Forwarded", "Host",
+	"Link", "Location", "Origin", "Proxy-Authorization", "Referer",
+	"Server", "Set-Cookie", "Upgrade", "User-Agent", "Via",
+	"WWW-Authenticate", "X-Forwarded-For", "X-Forwarded-Host",
+}
+
+// HeaderEnricher merges the allow-listed HTTP headers from whichever
+// of HttpRequest/HttpResponse is present on the event into a single
+// "header" field.
+type HeaderEnricher struct {
+	wanted map[string]bool
+}
+
+func newHeaderEnricher() *HeaderEnricher {
+
+	names := defaultHttpHeaders
+	if v := utils.Getenv("HEADER_ALLOWLIST", ""); v != "" {
+		names = strings.Split(v, ",")
+	}
+
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[strings.TrimSpace(n)] = true
+	}
+
+	return &HeaderEnricher{wanted: wanted}
+
+}
+
+func (h *HeaderEnricher) Columns() []Column {
+
+	fields := make([]Column, 0, len(h.wanted))
+	for name := range h.wanted {
+		fields = append(fields, Column{
+			Name: httpHeaderFieldName(name),
+			Mode: "NULLABLE",
+			Type: "STRING",
+		})
+	}
+
+	return []Column{
+		{Name: "header", Mode: "NULLABLE", Type: "RECORD", Fields: fields},
+	}
+
+}
+
+func (h *HeaderEnricher) Enrich(e *dt.Event, row map[string]bigquery.JsonValue) error {
+
+	if e.Action != "http_request" && e.Action != "http_response" {
+		return nil
+	}
+
+	hdr := map[string]string{}
+
+	if e.HttpRequest != nil {
+		h.collect(hdr, e.HttpRequest.Header)
+	}
+	if e.HttpResponse != nil {
+		h.collect(hdr, e.HttpResponse.Header)
+	}
+
+	row["header"] = &hdr
+
+	return nil
+
+}
+
+func (h *HeaderEnricher) collect(dest map[string]string, src map[string]string) {
+	for k, v := range src {
+		if h.wanted[k] {
+			dest[httpHeaderFieldName(k)] = v
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"google.golang.org/api/bigquery/v2"
+)
+
+func TestHeaderEnricherCollectsOnlyAllowlisted(t *testing.T) {
+
+	h := &HeaderEnricher{wanted: map[string]bool{"Content-Type": true}}
+
+	e := &dt.Event{
+		Action: "http_request",
+		HttpRequest: &dt.HttpRequest{
+			Header: map[string]string{
+				"Content-Type":      "application/json",
+				"X-Not-Allowlisted": "secret",
+			},
+		},
+	}
+
+	row := map[string]bigquery.JsonValue{}
+	_ = h.Enrich(e, row)
+
+	hdr, ok := row["header"].(*map[string]string)
+	if !ok {
+		t.Fatalf("expected header field to be set")
+	}
+
+	if (*hdr)["contenttype"] != "application/json" {
+		t.Fatalf("got %v, want contenttype=application/json", *hdr)
+	}
+
+	if _, ok := (*hdr)["xnotallowlisted"]; ok {
+		t.Fatalf("non-allowlisted header leaked into row: %v", *hdr)
+	}
+
+}
+
+func TestHeaderEnricherIgnoresOtherActions(t *testing.T) {
+
+	h := &HeaderEnricher{wanted: map[string]bool{"Content-Type": true}}
+
+	e := &dt.Event{Action: "dns_message"}
+
+	row := map[string]bigquery.JsonValue{}
+	_ = h.Enrich(e, row)
+
+	if _, ok := row["header"]; ok {
+		t.Fatalf("expected no header field for a non-HTTP action")
+	}
+
+}
@@ -0,0 +1,85 @@
+package main
+
+//
+// IndicatorEnricher tags rows that match a loaded indicator-of-
+// compromise list (IOC_FILE, one indicator per line: IPs, domains,
+// URLs).
+//
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// IndicatorEnricher checks row fields and DNS answers against a set of
+// loaded indicators.
+type IndicatorEnricher struct {
+	iocs map[string]bool
+}
+
+func newIndicatorEnricher(path string) (*IndicatorEnricher, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	iocs := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		iocs[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &IndicatorEnricher{iocs: iocs}, nil
+
+}
+
+func (i *IndicatorEnricher) Columns() []Column {
+	return []Column{
+		{Name: "ioc_match", Mode: "REPEATED", Type: "STRING"},
+	}
+}
+
+func (i *IndicatorEnricher) Enrich(e *dt.Event, row map[string]bigquery.JsonValue) error {
+
+	var hits []string
+
+	for _, field := range []string{"ipv4_src", "ipv4_dest", "url"} {
+		if v, ok := row[field]; ok {
+			if s, ok := v.(string); ok && i.iocs[s] {
+				hits = append(hits, s)
+			}
+		}
+	}
+
+	if e.DnsMessage != nil {
+		for _, a := range e.DnsMessage.Answer {
+			if i.iocs[a.Address] {
+				hits = append(hits, a.Address)
+			}
+			if i.iocs[a.Name] {
+				hits = append(hits, a.Name)
+			}
+		}
+	}
+
+	if len(hits) > 0 {
+		row["ioc_match"] = hits
+	}
+
+	return nil
+
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+	"google.golang.org/api/bigquery/v2"
+)
+
+func writeIocFile(t *testing.T, lines ...string) string {
+
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "iocs.txt")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("couldn't create temp IOC file: %s", err.Error())
+	}
+	defer f.Close()
+
+	for _, l := range lines {
+		if _, err := f.WriteString(l + "\n"); err != nil {
+			t.Fatalf("couldn't write temp IOC file: %s", err.Error())
+		}
+	}
+
+	return path
+
+}
+
+func TestIndicatorEnricherLoadSkipsBlankAndComments(t *testing.T) {
+
+	path := writeIocFile(t, "1.2.3.4", "", "# a comment", "evil.example.com")
+
+	e, err := newIndicatorEnricher(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if len(e.iocs) != 2 || !e.iocs["1.2.3.4"] || !e.iocs["evil.example.com"] {
+		t.Fatalf("got %v, want exactly {1.2.3.4, evil.example.com}", e.iocs)
+	}
+
+}
+
+func TestIndicatorEnricherMatchesRowFields(t *testing.T) {
+
+	path := writeIocFile(t, "1.2.3.4")
+
+	e, err := newIndicatorEnricher(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	row := map[string]bigquery.JsonValue{"ipv4_dest": "1.2.3.4"}
+
+	if err := e.Enrich(&dt.Event{}, row); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	hits, ok := row["ioc_match"].([]string)
+	if !ok || len(hits) != 1 || hits[0] != "1.2.3.4" {
+		t.Fatalf("got %v, want [\"1.2.3.4\"]", row["ioc_match"])
+	}
+
+}
+
+func TestIndicatorEnricherNoMatch(t *testing.T) {
+
+	path := writeIocFile(t, "1.2.3.4")
+
+	e, err := newIndicatorEnricher(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	row := map[string]bigquery.JsonValue{"ipv4_dest": "5.6.7.8"}
+
+	if err := e.Enrich(&dt.Event{}, row); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	if _, ok := row["ioc_match"]; ok {
+		t.Fatalf("expected no ioc_match for a non-matching address")
+	}
+
+}
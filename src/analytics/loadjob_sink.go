@@ -0,0 +1,317 @@
+package main
+
+//
+// LoadJobSink batches rows into newline-delimited JSON and submits them
+// to BigQuery as load jobs (Jobs.Insert) rather than streaming them row
+// by row. This avoids the streaming insert quota and per-row billing at
+// the cost of load latency; LOAD_INTERVAL controls how often a partial
+// batch is flushed as well as more than insert_batch rows triggering an
+// early flush. Rows can optionally be staged through a GCS prefix
+// (LOAD_STAGE=gcs://bucket/prefix) before the load job references them;
+// otherwise the NDJSON batch is uploaded directly as load job media.
+//
+// A load job submission that fails (Jobs.Insert returns an error) is
+// retried with the same exponential backoff and jitter policy as
+// StreamSink (MAX_RETRIES/BACKOFF_MAX); once retries are exhausted the
+// whole batch is forwarded to DLQ_QUEUE rather than dropped, same as
+// the streaming sink. The job itself is not waited on: a job that is
+// accepted and then fails while running is neither retried nor
+// dead-lettered, and its rows are already counted as inserted.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/storage/v1"
+)
+
+// Default interval between load job flushes, overridden by LOAD_INTERVAL.
+const defaultLoadInterval = 5 * time.Minute
+
+// LoadJobSink writes rows to BigQuery using batch load jobs.
+type LoadJobSink struct {
+	project string
+	dataset string
+	table   string
+	svc     *bigquery.Service
+
+	bucket string
+	prefix string
+	gcs    *storage.Service
+
+	maxRetries int
+	backoffMax time.Duration
+	dlqQueue   string
+
+	lock   sync.Mutex
+	rows   [][]byte
+	msgs   [][]byte // Original event per row, same index as rows.
+	worker *worker.Worker
+}
+
+func (s *LoadJobSink) Init(w *work) error {
+
+	s.project = w.project
+	s.dataset = w.dataset
+	s.table = w.table
+	s.svc = w.svc
+
+	stage := utils.Getenv("LOAD_STAGE", "")
+	if stage != "" {
+
+		bucket, prefix, err := parseGcsUri(stage)
+		if err != nil {
+			utils.Log("LOAD_STAGE: %s", err.Error())
+			return err
+		}
+		s.bucket = bucket
+		s.prefix = prefix
+
+		s.gcs, err = storage.New(w.client)
+		if err != nil {
+			utils.Log("Couldn't create storage client: %s", err.Error())
+			return err
+		}
+
+	}
+
+	s.maxRetries = defaultMaxRetries
+	if v := utils.Getenv("MAX_RETRIES", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			utils.Log("MAX_RETRIES: %s, using default", err.Error())
+		} else {
+			s.maxRetries = n
+		}
+	}
+
+	s.backoffMax = defaultBackoffMax
+	if v := utils.Getenv("BACKOFF_MAX", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			utils.Log("BACKOFF_MAX: %s, using default", err.Error())
+		} else if d <= 0 {
+			utils.Log("BACKOFF_MAX: must be positive, using default")
+		} else {
+			s.backoffMax = d
+		}
+	}
+
+	s.dlqQueue = utils.Getenv("DLQ_QUEUE", "")
+	if err := checkDlqQueue(s.dlqQueue, w.outputs); err != nil {
+		utils.Log("DLQ_QUEUE: %s", err.Error())
+		return err
+	}
+
+	interval := defaultLoadInterval
+	if v := utils.Getenv("LOAD_INTERVAL", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			utils.Log("LOAD_INTERVAL: %s, using default", err.Error())
+		} else {
+			interval = d
+		}
+	}
+
+	go s.run(interval)
+
+	return nil
+
+}
+
+// run periodically flushes whatever has built up since the last load
+// job, so a low-traffic deployment doesn't hold rows indefinitely.
+func (s *LoadJobSink) run(interval time.Duration) {
+
+	t := time.NewTicker(interval)
+	for range t.C {
+		err := s.Flush()
+		if err != nil {
+			utils.Log("LoadJobSink: periodic flush: %s", err.Error())
+		}
+	}
+
+}
+
+func (s *LoadJobSink) Write(row *bigquery.TableDataInsertAllRequestRows, msg []byte, w *worker.Worker) error {
+
+	enc, err := json.Marshal(row.Json)
+	if err != nil {
+		utils.Log("LoadJobSink: couldn't encode row: %s", err.Error())
+		return nil
+	}
+
+	s.lock.Lock()
+	s.rows = append(s.rows, enc)
+	s.msgs = append(s.msgs, msg)
+	s.worker = w
+	n := len(s.rows)
+	s.lock.Unlock()
+
+	if n > insert_batch {
+		return s.Flush()
+	}
+
+	return nil
+
+}
+
+// Flush hands off the currently buffered batch and submits it as a
+// load job, retrying a failed submission with the same backoff policy
+// as StreamSink and, once that's exhausted, dead-lettering the whole
+// batch rather than dropping it -- a load job's failure (unlike
+// InsertAll) is all-or-nothing, so there's no partial/poisoned-row
+// case to handle separately. It returns once the job is submitted,
+// without waiting for the job to finish.
+func (s *LoadJobSink) Flush() error {
+
+	// Registered before the lock, not just around the load job below,
+	// so a concurrent shutdown can't observe the buffer already
+	// swapped out (len(s.rows) == 0) but flushWG still at zero and
+	// exit while this flush is still running.
+	flushWG.Add(1)
+	defer flushWG.Done()
+
+	s.lock.Lock()
+
+	if len(s.rows) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+
+	rows := s.rows
+	msgs := s.msgs
+	w := s.worker
+	s.rows = nil
+	s.msgs = nil
+
+	s.lock.Unlock()
+
+	flushesTotal.Inc()
+
+	ndjson := bytes.Join(rows, []byte("\n"))
+	ndjson = append(ndjson, '\n')
+
+	var sourceUri string
+	if s.gcs != nil {
+
+		uri, err := s.stage(ndjson)
+		if err != nil {
+			utils.Log("LoadJobSink: staging to GCS failed: %s", err.Error())
+			deadLetterAll(s.dlqQueue, w, msgs, err.Error())
+			return nil
+		}
+		sourceUri = uri
+
+	}
+
+	var err error
+
+	for attempt := 0; ; attempt++ {
+
+		var job bigquery.Job
+		job.Configuration = &bigquery.JobConfiguration{
+			Load: &bigquery.JobConfigurationLoad{
+				DestinationTable: &bigquery.TableReference{
+					ProjectId: s.project,
+					DatasetId: s.dataset,
+					TableId:   s.table,
+				},
+				SourceFormat:     "NEWLINE_DELIMITED_JSON",
+				WriteDisposition: "WRITE_APPEND",
+			},
+		}
+
+		call := s.svc.Jobs.Insert(s.project, &job)
+		if sourceUri != "" {
+			job.Configuration.Load.SourceUris = []string{sourceUri}
+		} else {
+			call = call.Media(bytes.NewReader(ndjson))
+		}
+
+		start := time.Now()
+		_, err = call.Do()
+		insertLatency.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			break
+		}
+
+		apiErrorsTotal.WithLabelValues(apiErrorCode(err)).Inc()
+
+		if !retriable(err) || attempt >= s.maxRetries {
+			utils.Log("LoadJobSink: load job failed, giving up after %d attempt(s): %s",
+				attempt+1, err.Error())
+			deadLetterAll(s.dlqQueue, w, msgs, err.Error())
+			return nil
+		}
+
+		retriesTotal.Inc()
+		backoff := retryBackoff(attempt, s.backoffMax)
+		utils.Log("LoadJobSink: load job failed: %s, retrying in %s", err.Error(), backoff)
+		time.Sleep(backoff)
+
+	}
+
+	rowsInserted.Add(float64(len(rows)))
+
+	return nil
+
+}
+
+func (s *LoadJobSink) Close() error {
+	return s.Flush()
+}
+
+// stage uploads a batch of NDJSON rows to the configured GCS prefix and
+// returns the gs:// URI the load job should read from.
+func (s *LoadJobSink) stage(ndjson []byte) (string, error) {
+
+	name := fmt.Sprintf("%d.json", time.Now().UnixNano())
+	if s.prefix != "" {
+		name = strings.TrimSuffix(s.prefix, "/") + "/" + name
+	}
+
+	obj := &storage.Object{
+		Bucket: s.bucket,
+		Name:   name,
+	}
+
+	_, err := s.gcs.Objects.Insert(s.bucket, obj).
+		Media(bytes.NewReader(ndjson)).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("gs://%s/%s", s.bucket, name), nil
+
+}
+
+// parseGcsUri splits a LOAD_STAGE value of the form gcs://bucket/prefix
+// into its bucket and prefix parts.
+func parseGcsUri(uri string) (bucket, prefix string, err error) {
+
+	const scheme = "gcs://"
+	if !strings.HasPrefix(uri, scheme) {
+		return "", "", fmt.Errorf("LOAD_STAGE must be of the form gcs://bucket/prefix")
+	}
+
+	rest := strings.TrimPrefix(uri, scheme)
+	parts := strings.SplitN(rest, "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		prefix = parts[1]
+	}
+
+	return bucket, prefix, nil
+
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseGcsUri(t *testing.T) {
+
+	bucket, prefix, err := parseGcsUri("gcs://my-bucket/staging/dir")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if bucket != "my-bucket" || prefix != "staging/dir" {
+		t.Fatalf("got bucket=%q prefix=%q, want bucket=\"my-bucket\" prefix=\"staging/dir\"", bucket, prefix)
+	}
+
+	bucket, prefix, err = parseGcsUri("gcs://my-bucket")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if bucket != "my-bucket" || prefix != "" {
+		t.Fatalf("got bucket=%q prefix=%q, want bucket=\"my-bucket\" prefix=\"\"", bucket, prefix)
+	}
+
+	if _, _, err := parseGcsUri("s3://wrong-scheme/prefix"); err == nil {
+		t.Fatalf("expected an error for a non-gcs:// URI")
+	}
+
+}
@@ -0,0 +1,96 @@
+package main
+
+//
+// Prometheus metrics and health endpoints. Previously the only
+// observability the loader had was utils.Log lines; this exposes
+// counters/histograms operators can alert on (e.g. ingestion stalls,
+// a rising dead-letter rate) plus /healthz and /readyz for Kubernetes.
+//
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Default port for the metrics/health HTTP server, overridden by
+// METRICS_PORT.
+const defaultMetricsPort = "8088"
+
+var (
+	eventsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bigquery_events_processed_total",
+		Help: "Events received by the handler, whether or not they decode.",
+	})
+
+	rowsInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bigquery_rows_inserted_total",
+		Help: "Rows successfully written to BigQuery.",
+	})
+
+	insertLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bigquery_insert_latency_seconds",
+		Help:    "Latency of BigQuery insert/load calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	flushesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bigquery_flushes_total",
+		Help: "Batch flushes performed, successful or not.",
+	})
+
+	retriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bigquery_retries_total",
+		Help: "Insert retries performed after a transient failure.",
+	})
+
+	deadLetterTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bigquery_dead_letter_rows_total",
+		Help: "Rows forwarded to the dead-letter queue.",
+	})
+
+	apiErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bigquery_api_errors_total",
+		Help: "BigQuery API errors, by HTTP status code.",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(eventsProcessed, rowsInserted, insertLatency,
+		flushesTotal, retriesTotal, deadLetterTotal, apiErrorsTotal)
+}
+
+// startMetricsServer serves /metrics, /healthz and /readyz on
+// METRICS_PORT (default 8088). /readyz only succeeds once the target
+// table can actually be reached.
+func startMetricsServer(s *work) {
+
+	port := utils.Getenv("METRICS_PORT", defaultMetricsPort)
+
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		_, err := s.svc.Tables.Get(s.project, s.dataset, s.table).Do()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		err := http.ListenAndServe(":"+port, mux)
+		if err != nil {
+			utils.Log("Metrics server: %s", err.Error())
+		}
+	}()
+
+}
@@ -0,0 +1,150 @@
+package main
+
+//
+// Declarative schema support. Rather than hard-coding the BigQuery
+// table schema and the event-to-row field mapping in Go, both are
+// driven by a schema file (SCHEMA=path, JSON or YAML) listing the
+// table's columns. A top-level column (a RECORD as well as a leaf) may
+// carry a JSONPath-like "extract" expression (dotted, with "|"
+// separating fallback alternatives) that pulls the column's value out
+// of the decoded event; extract expressions on nested fields are not
+// evaluated. Adding a field --
+// a new header, a GeoIP column, whatever -- becomes an edit to the
+// schema file rather than the loader's source.
+//
+// If SCHEMA isn't set, defaultSchema() below is used, which describes
+// the same columns the loader has always written.
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/api/bigquery/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Column describes one BigQuery column and, for top-level columns, how
+// to pull its value out of a decoded event.
+type Column struct {
+	Name    string   `json:"name" yaml:"name"`
+	Type    string   `json:"type" yaml:"type"`
+	Mode    string   `json:"mode" yaml:"mode"`
+	Extract string   `json:"extract,omitempty" yaml:"extract,omitempty"`
+	Fields  []Column `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// loadSchema reads the column list from a JSON or YAML file, chosen by
+// the file extension (.yaml/.yml is YAML, anything else JSON).
+func loadSchema(path string) ([]Column, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cols []Column
+
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		err = yaml.Unmarshal(data, &cols)
+	} else {
+		err = json.Unmarshal(data, &cols)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cols, nil
+
+}
+
+// toFieldSchema converts the declarative column list into the
+// bigquery.TableFieldSchema tree the API expects.
+func toFieldSchema(cols []Column) []*bigquery.TableFieldSchema {
+
+	fields := make([]*bigquery.TableFieldSchema, 0, len(cols))
+
+	for _, c := range cols {
+		fields = append(fields, &bigquery.TableFieldSchema{
+			Name:   c.Name,
+			Type:   c.Type,
+			Mode:   c.Mode,
+			Fields: toFieldSchema(c.Fields),
+		})
+	}
+
+	return fields
+
+}
+
+// newColumns returns the columns present in cols but missing (by name)
+// from live, so they can be added to an existing table with
+// Tables.Patch. BigQuery only supports additive schema changes, so
+// this only looks at new top-level columns, not fields added to an
+// existing RECORD column.
+func newColumns(live []*bigquery.TableFieldSchema, cols []Column) []Column {
+
+	have := map[string]bool{}
+	for _, f := range live {
+		have[f.Name] = true
+	}
+
+	var added []Column
+	for _, c := range cols {
+		if !have[c.Name] {
+			added = append(added, c)
+		}
+	}
+
+	return added
+
+}
+
+// extract resolves a dotted path (e.g. "http_request.method") against
+// a decoded JSON event.
+func extract(event map[string]interface{}, path string) (interface{}, bool) {
+
+	var cur interface{} = event
+
+	for _, part := range strings.Split(path, ".") {
+
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+
+	}
+
+	return cur, true
+
+}
+
+// extractColumn resolves a column's extract expression, trying each
+// "|"-separated alternative in turn and returning the first that's
+// present. Alternatives exist because several actions populate the
+// same column (e.g. http_request.method and sip_request.method both
+// feed "method").
+func extractColumn(event map[string]interface{}, col Column) (interface{}, bool) {
+
+	for _, path := range strings.Split(col.Extract, "|") {
+
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		if v, ok := extract(event, path); ok {
+			return v, true
+		}
+
+	}
+
+	return nil, false
+
+}
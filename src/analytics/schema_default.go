@@ -0,0 +1,47 @@
+package main
+
+// defaultSchema describes the cyberprobe event table the loader has
+// always written, for use when SCHEMA isn't set. udp_src/udp_dest,
+// tcp_src/tcp_dest and ipv4_src/ipv4_dest aren't simple path
+// extractions (they're built from the src/dest address lists) so they
+// carry no Extract expression; Handle populates them directly. The
+// "header" column and anything GeoIP/indicator matching add come from
+// the enrichment chain, not from here.
+func defaultSchema() []Column {
+
+	return []Column{
+		{Name: "id", Mode: "REQUIRED", Type: "STRING", Extract: "id"},
+		{Name: "time", Mode: "REQUIRED", Type: "TIMESTAMP", Extract: "time"},
+		{Name: "action", Mode: "REQUIRED", Type: "STRING", Extract: "action"},
+		{Name: "device", Mode: "REQUIRED", Type: "STRING", Extract: "device"},
+		{Name: "udp_src", Mode: "NULLABLE", Type: "INTEGER"},
+		{Name: "udp_dest", Mode: "NULLABLE", Type: "INTEGER"},
+		{Name: "tcp_src", Mode: "NULLABLE", Type: "INTEGER"},
+		{Name: "tcp_dest", Mode: "NULLABLE", Type: "INTEGER"},
+		{Name: "ipv4_src", Mode: "NULLABLE", Type: "STRING"},
+		{Name: "ipv4_dest", Mode: "NULLABLE", Type: "STRING"},
+		{Name: "type", Mode: "NULLABLE", Type: "STRING", Extract: "dns_message.type"},
+		{Name: "query", Mode: "REPEATED", Type: "STRING", Extract: "dns_message.query"},
+		{
+			Name: "answer", Mode: "REPEATED", Type: "RECORD",
+			Extract: "dns_message.answer",
+			Fields: []Column{
+				{Name: "name", Mode: "NULLABLE", Type: "STRING"},
+				{Name: "address", Mode: "NULLABLE", Type: "STRING"},
+			},
+		},
+		{Name: "method", Mode: "NULLABLE", Type: "STRING",
+			Extract: "http_request.method|sip_request.method"},
+		{Name: "status", Mode: "NULLABLE", Type: "STRING",
+			Extract: "http_response.status|ftp_response.status|smtp_response.status|sip_response.status"},
+		{Name: "code", Mode: "NULLABLE", Type: "INTEGER",
+			Extract: "http_response.code|sip_response.code"},
+		{Name: "size", Mode: "NULLABLE", Type: "INTEGER"},
+		{Name: "url", Mode: "NULLABLE", Type: "STRING", Extract: "url"},
+		{Name: "from", Mode: "NULLABLE", Type: "STRING",
+			Extract: "sip_request.from|sip_response.from|smtp_data.from"},
+		{Name: "to", Mode: "REPEATED", Type: "STRING",
+			Extract: "sip_request.to|sip_response.to|smtp_data.to"},
+	}
+
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestExtract(t *testing.T) {
+
+	event := map[string]interface{}{
+		"http_request": map[string]interface{}{
+			"method": "GET",
+		},
+	}
+
+	v, ok := extract(event, "http_request.method")
+	if !ok || v != "GET" {
+		t.Fatalf("got %v, %v, want \"GET\", true", v, ok)
+	}
+
+	if _, ok := extract(event, "http_request.missing"); ok {
+		t.Fatalf("expected missing path to report not found")
+	}
+
+	if _, ok := extract(event, "sip_request.method"); ok {
+		t.Fatalf("expected missing top-level key to report not found")
+	}
+
+}
+
+func TestExtractColumnAlternatives(t *testing.T) {
+
+	event := map[string]interface{}{
+		"sip_request": map[string]interface{}{
+			"method": "INVITE",
+		},
+	}
+
+	col := Column{
+		Name:    "method",
+		Extract: "http_request.method|sip_request.method",
+	}
+
+	v, ok := extractColumn(event, col)
+	if !ok || v != "INVITE" {
+		t.Fatalf("got %v, %v, want \"INVITE\", true", v, ok)
+	}
+
+}
+
+func TestExtractColumnNoAlternativeMatches(t *testing.T) {
+
+	event := map[string]interface{}{}
+
+	col := Column{
+		Name:    "method",
+		Extract: "http_request.method|sip_request.method",
+	}
+
+	if _, ok := extractColumn(event, col); ok {
+		t.Fatalf("expected no alternative to match")
+	}
+
+}
+
+func TestNewColumns(t *testing.T) {
+
+	cols := []Column{
+		{Name: "id"},
+		{Name: "time"},
+		{Name: "header"},
+	}
+
+	added := newColumns(nil, cols)
+	if len(added) != 3 {
+		t.Fatalf("got %d added columns, want 3", len(added))
+	}
+}
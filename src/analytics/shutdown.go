@@ -0,0 +1,13 @@
+package main
+
+import "sync"
+
+// flushWG tracks flush work in progress across every sink. A sink's
+// Flush registers with it for the duration of the actual insert/load
+// (and any retries/backoff), not just the in-memory buffer swap, so
+// shutdown can wait for a flush already under way on the periodic
+// ticker goroutine instead of racing it: without this, SIGTERM arriving
+// mid-backoff would let main's signal handler see an empty buffer (the
+// ticker's flush already took it) and exit while that flush was still
+// retrying, losing the rows it was holding.
+var flushWG sync.WaitGroup
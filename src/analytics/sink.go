@@ -0,0 +1,50 @@
+package main
+
+//
+// Sink abstracts the storage backend that rows are written to. The
+// loader supports more than one way of getting rows into BigQuery:
+// streaming inserts are low-latency but billed per row and subject to
+// per-project streaming quotas, while load jobs batch rows and trade
+// latency for throughput. SINK selects between them.
+//
+
+import (
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"google.golang.org/api/bigquery/v2"
+)
+
+// Sink is implemented by each supported storage backend.
+type Sink interface {
+
+	// Init prepares the sink for use, using the project/dataset/table
+	// and BigQuery service handle already set up on w.
+	Init(w *work) error
+
+	// Write queues a single row for storage. msg is the original event
+	// the row was built from, and w is the worker handle the row
+	// arrived on; a sink that supports a dead-letter queue uses them
+	// to forward rows it can't store. Either may be ignored by sinks
+	// that don't need them.
+	Write(row *bigquery.TableDataInsertAllRequestRows, msg []byte, w *worker.Worker) error
+
+	// Flush forces any buffered rows to be written out immediately.
+	Flush() error
+
+	// Close flushes outstanding rows and releases resources held by
+	// the sink.
+	Close() error
+}
+
+// newSink constructs the sink selected by the SINK environment
+// variable ("stream", the default, or "loadjob").
+func newSink() Sink {
+
+	switch utils.Getenv("SINK", "stream") {
+	case "loadjob":
+		return &LoadJobSink{}
+	default:
+		return &StreamSink{}
+	}
+
+}
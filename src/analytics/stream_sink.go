@@ -0,0 +1,272 @@
+package main
+
+//
+// StreamSink is the original loader behaviour: rows are batched in
+// memory and pushed to BigQuery with the streaming insert API
+// (Tabledata.InsertAll) once more than insert_batch rows have built up.
+//
+// InsertAll can fail wholesale (retriable HTTP errors, e.g. 429 or
+// 5xx) or partially (TableDataInsertAllResponse.InsertErrors names
+// specific poison rows while the rest of the batch is accepted). A
+// wholesale retriable failure is retried with exponential backoff and
+// jitter up to MAX_RETRIES times; whatever can't be stored -- poison
+// rows, or the whole batch once retries are exhausted -- is forwarded
+// to DLQ_QUEUE with the original event and the BigQuery error attached,
+// rather than silently dropped.
+//
+// A background goroutine flushes whatever has built up every
+// FLUSH_INTERVAL (default 10s), so a low-traffic deployment doesn't
+// hold rows indefinitely; main also flushes on SIGINT/SIGTERM so the
+// tail isn't lost on a Kubernetes rolling restart. s.rows/s.count/
+// s.msgs are touched by both the caller's goroutine (Write) and the
+// ticker goroutine, so they're guarded by a mutex.
+//
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// Defaults for the retry policy, overridden by MAX_RETRIES/BACKOFF_MAX.
+const (
+	defaultMaxRetries = 5
+	defaultBackoffMax = 30 * time.Second
+)
+
+// Default interval between background flushes, overridden by
+// FLUSH_INTERVAL.
+const defaultFlushInterval = 10 * time.Second
+
+// StreamSink writes rows to BigQuery using Tabledata.InsertAll.
+type StreamSink struct {
+	project string
+	dataset string
+	table   string
+	svc     *bigquery.Service
+
+	maxRetries int
+	backoffMax time.Duration
+	dlqQueue   string
+
+	lock   sync.Mutex
+	count  int
+	rows   bigquery.TableDataInsertAllRequest
+	msgs   [][]byte // Original event per row, same index as rows.Rows.
+	worker *worker.Worker
+}
+
+func (s *StreamSink) Init(w *work) error {
+
+	s.project = w.project
+	s.dataset = w.dataset
+	s.table = w.table
+	s.svc = w.svc
+
+	s.maxRetries = defaultMaxRetries
+	if v := utils.Getenv("MAX_RETRIES", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			utils.Log("MAX_RETRIES: %s, using default", err.Error())
+		} else {
+			s.maxRetries = n
+		}
+	}
+
+	s.backoffMax = defaultBackoffMax
+	if v := utils.Getenv("BACKOFF_MAX", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			utils.Log("BACKOFF_MAX: %s, using default", err.Error())
+		} else if d <= 0 {
+			utils.Log("BACKOFF_MAX: must be positive, using default")
+		} else {
+			s.backoffMax = d
+		}
+	}
+
+	s.dlqQueue = utils.Getenv("DLQ_QUEUE", "")
+	if err := checkDlqQueue(s.dlqQueue, w.outputs); err != nil {
+		utils.Log("DLQ_QUEUE: %s", err.Error())
+		return err
+	}
+
+	interval := defaultFlushInterval
+	if v := utils.Getenv("FLUSH_INTERVAL", ""); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			utils.Log("FLUSH_INTERVAL: %s, using default", err.Error())
+		} else {
+			interval = d
+		}
+	}
+
+	go s.run(interval)
+
+	return nil
+
+}
+
+// run periodically flushes whatever has built up since the last
+// insert, so a low-traffic deployment doesn't hold rows indefinitely.
+func (s *StreamSink) run(interval time.Duration) {
+
+	t := time.NewTicker(interval)
+	for range t.C {
+		err := s.Flush()
+		if err != nil {
+			utils.Log("StreamSink: periodic flush: %s", err.Error())
+		}
+	}
+
+}
+
+func (s *StreamSink) Write(row *bigquery.TableDataInsertAllRequestRows, msg []byte, w *worker.Worker) error {
+
+	s.lock.Lock()
+	s.rows.Rows = append(s.rows.Rows, row)
+	s.msgs = append(s.msgs, msg)
+	s.count++
+	s.worker = w
+	n := s.count
+	s.lock.Unlock()
+
+	if n > insert_batch {
+		return s.Flush()
+	}
+
+	return nil
+
+}
+
+// Flush hands off the currently buffered batch and writes it to
+// BigQuery. Buffering a fresh batch is quick and happens under the
+// lock; the InsertAll call (and any retries) run outside it so Write
+// isn't blocked while a flush is in flight.
+func (s *StreamSink) Flush() error {
+
+	// Registered before the lock, not just around the insert below, so
+	// a concurrent shutdown can't observe the buffer already swapped
+	// out (count == 0) but flushWG still at zero and exit while this
+	// flush is still running.
+	flushWG.Add(1)
+	defer flushWG.Done()
+
+	s.lock.Lock()
+
+	if s.count == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+
+	rows := s.rows
+	msgs := s.msgs
+	w := s.worker
+	s.reset()
+
+	s.lock.Unlock()
+
+	flushesTotal.Inc()
+
+	// FIXME: Don't need to do this at all?
+	rows.Kind = "biquery#tableDataInsertAllRequest"
+
+	// Store the valid rows even when some are rejected, so InsertErrors
+	// names just the poison rows.
+	rows.SkipInvalidRows = true
+
+	var resp *bigquery.TableDataInsertAllResponse
+	var err error
+
+	for attempt := 0; ; attempt++ {
+
+		start := time.Now()
+		resp, err = s.svc.Tabledata.InsertAll(s.project, s.dataset,
+			s.table, &rows).Do()
+		insertLatency.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			break
+		}
+
+		apiErrorsTotal.WithLabelValues(apiErrorCode(err)).Inc()
+
+		if !retriable(err) || attempt >= s.maxRetries {
+			utils.Log("InsertAll: giving up after %d attempt(s): %s",
+				attempt+1, err.Error())
+			deadLetterAll(s.dlqQueue, w, msgs, err.Error())
+			return nil
+		}
+
+		retriesTotal.Inc()
+		backoff := retryBackoff(attempt, s.backoffMax)
+		utils.Log("InsertAll: %s, retrying in %s", err.Error(), backoff)
+		time.Sleep(backoff)
+
+	}
+
+	rowsInserted.Add(float64(len(rows.Rows) - len(resp.InsertErrors)))
+	deadLetterInsertErrors(s.dlqQueue, w, msgs, resp.InsertErrors)
+
+	return nil
+
+}
+
+func (s *StreamSink) Close() error {
+	return s.Flush()
+}
+
+func (s *StreamSink) reset() {
+	s.count = 0
+	s.rows.Rows = []*bigquery.TableDataInsertAllRequestRows{}
+	s.msgs = nil
+}
+
+// retriable reports whether a BigQuery API error is worth retrying --
+// rate limiting or a server-side problem, rather than a malformed
+// request.
+func retriable(err error) bool {
+
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	return gerr.Code == 429 || gerr.Code >= 500
+
+}
+
+// apiErrorCode extracts the HTTP status code from a BigQuery API error
+// for the api_errors_total metric, falling back to "unknown" for
+// errors that didn't come from the API itself (e.g. a network error).
+func apiErrorCode(err error) string {
+
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return "unknown"
+	}
+
+	return strconv.Itoa(gerr.Code)
+
+}
+
+// retryBackoff computes an exponential backoff with jitter for the
+// given attempt number, capped at max.
+func retryBackoff(attempt int, max time.Duration) time.Duration {
+
+	backoff := time.Second << uint(attempt)
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff)))
+
+	return backoff/2 + jitter/2
+
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetriable(t *testing.T) {
+
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 400}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{errString("boom"), false},
+	}
+
+	for _, c := range cases {
+		if got := retriable(c.err); got != c.want {
+			t.Errorf("retriable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+
+}
+
+func TestApiErrorCode(t *testing.T) {
+
+	if got := apiErrorCode(&googleapi.Error{Code: 503}); got != "503" {
+		t.Errorf("got %q, want \"503\"", got)
+	}
+
+	if got := apiErrorCode(errString("boom")); got != "unknown" {
+		t.Errorf("got %q, want \"unknown\"", got)
+	}
+
+}
+
+func TestRetryBackoffCapped(t *testing.T) {
+
+	max := 5 * time.Second
+
+	for attempt := 0; attempt < 10; attempt++ {
+		backoff := retryBackoff(attempt, max)
+		if backoff < 0 || backoff > max {
+			t.Fatalf("attempt %d: backoff %s out of [0, %s]", attempt, backoff, max)
+		}
+	}
+
+}
+
+type errString string
+
+func (e errString) Error() string { return string(e) }